@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// RoomPolicy is the access policy for a room: which capabilities are
+// required to join, and how a client proves it holds them.
+type RoomPolicy struct {
+	Room     string       `json:"room"`
+	Password string       `json:"password,omitempty"`
+	Required []Permission `json:"required,omitempty"`
+}
+
+// roomToken is the payload of a signed room ticket, analogous to JWT claims.
+type roomToken struct {
+	Sub         string       `json:"sub"`
+	Room        string       `json:"room"`
+	Permissions []Permission `json:"permissions"`
+	Exp         int64        `json:"exp"`
+}
+
+// authManager holds per-room access policies and signs/verifies the tokens
+// that grant entry to policy-protected rooms. A nil *authManager (the
+// default) means no authorization is configured and every room is open.
+type authManager struct {
+	secret []byte
+
+	mu       sync.RWMutex
+	policies map[string]RoomPolicy
+}
+
+func newAuthManager(secret, policyFile string) (*authManager, error) {
+	m := &authManager{secret: []byte(secret), policies: make(map[string]RoomPolicy)}
+
+	if policyFile == "" {
+		return m, nil
+	}
+
+	data, err := os.ReadFile(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	var policies []RoomPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		m.policies[p.Room] = p
+	}
+	return m, nil
+}
+
+func (m *authManager) policyFor(room string) (RoomPolicy, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.policies[room]
+	return p, ok
+}
+
+func (m *authManager) setPolicy(p RoomPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[p.Room] = p
+}
+
+// authorize checks a join attempt against the room's policy, if any. A nil
+// permissions result with a nil error means "no policy for this room, or a
+// password policy that was satisfied; fall back to the hub's default
+// permission assignment".
+func (m *authManager) authorize(room, token, password string) ([]Permission, error) {
+	policy, ok := m.policyFor(room)
+	if !ok {
+		return nil, nil
+	}
+
+	if policy.Password != "" {
+		if password != policy.Password {
+			return nil, errUnauthorized
+		}
+		return nil, nil
+	}
+
+	if token == "" {
+		return nil, errUnauthorized
+	}
+	claims, err := m.verifyToken(token)
+	if err != nil || claims.Room != room {
+		return nil, errUnauthorized
+	}
+	for _, required := range policy.Required {
+		if !hasPermission(claims.Permissions, required) {
+			return nil, errUnauthorized
+		}
+	}
+	return claims.Permissions, nil
+}
+
+// signToken mints a ticket for sub to join room with the given permissions,
+// valid until ttl elapses, in the format verifyToken accepts. No handler in
+// this package calls it; tickets are issued outside the server.
+func (m *authManager) signToken(sub, room string, permissions []Permission, ttl time.Duration) (string, error) {
+	claims := roomToken{
+		Sub:         sub,
+		Room:        room,
+		Permissions: permissions,
+		Exp:         time.Now().Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + m.sign(encoded), nil
+}
+
+func (m *authManager) verifyToken(token string) (roomToken, error) {
+	if len(m.secret) == 0 {
+		return roomToken{}, errors.New("no token secret configured")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return roomToken{}, errors.New("malformed token")
+	}
+	if !hmac.Equal([]byte(m.sign(parts[0])), []byte(parts[1])) {
+		return roomToken{}, errors.New("bad signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return roomToken{}, err
+	}
+	var claims roomToken
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return roomToken{}, err
+	}
+	if time.Now().Unix() > claims.Exp {
+		return roomToken{}, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func (m *authManager) sign(data string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authorizedAdmin checks r for an "Authorization: Bearer <secret>" header
+// matching the operator's configured secret. It fails closed: with no
+// secret configured, every request is rejected rather than every request
+// being allowed.
+func (m *authManager) authorizedAdmin(r *http.Request) bool {
+	if len(m.secret) == 0 {
+		return false
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if bearer == r.Header.Get("Authorization") {
+		return false
+	}
+	return hmac.Equal([]byte(bearer), m.secret)
+}
+
+// handleAdminRooms lets an operator register or update a room's access
+// policy at runtime instead of editing the policy file.
+func (m *authManager) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !m.authorizedAdmin(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var policy RoomPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "invalid policy", http.StatusBadRequest)
+		return
+	}
+	if policy.Room == "" {
+		http.Error(w, "room is required", http.StatusBadRequest)
+		return
+	}
+
+	m.setPolicy(policy)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// roomNamePattern restricts room names to a safe charset so they can be used
+// as a path component (recordingsDir/<room>/...) without risking traversal
+// via "../" or an absolute path.
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// defaultMaxPeers bounds how many simultaneous clients a room accepts when
+// the creator does not request a different size.
+const defaultMaxPeers = 8
+
+// disconnectGrace is how long a client's seat in the room is held open
+// after its websocket drops, waiting for it to resume with the same
+// SessionID.
+const disconnectGrace = 5 * time.Second
+
+// maxHistory bounds how many outbound messages are kept for replay on
+// resume.
+const maxHistory = 64
+
+// pongWait/pingPeriod keep the websocket's read deadline moving so a
+// half-open TCP connection (no FIN, no more packets) is noticed well within
+// disconnectGrace instead of lingering until the OS times it out.
+const (
+	pongWait   = 4 * time.Second
+	pingPeriod = pongWait / 2
+)
+
+type Client struct {
+	id              string
+	sessionID       string
+	room            string
+	conn            *websocket.Conn
+	send            chan SignalMessage
+	disconnectedAt  time.Time
+	disconnectTimer *time.Timer
+
+	// knownPeers is the set of other clients' IDs this client has last
+	// been told are in the room, used on resume to decide whether
+	// peer-joined/waiting needs to be re-sent at all.
+	knownPeers map[string]bool
+
+	// permMu guards permissions, which is read on the client's own
+	// readLoop goroutine (via can()) and written from handleOp running on
+	// the granting client's goroutine.
+	permMu      sync.Mutex
+	permissions []Permission
+
+	// historyMu guards history/nextSeq and also send/closed, so that
+	// checking whether the client's send channel is still open and
+	// actually sending or closing it can never race each other.
+	historyMu sync.Mutex
+	nextSeq   uint64
+	history   []SignalMessage
+	closed    bool // true once closeSend has closed send
+}
+
+func (c *Client) can(p Permission) bool {
+	c.permMu.Lock()
+	defer c.permMu.Unlock()
+	return hasPermission(c.permissions, p)
+}
+
+// permissionsSnapshot returns a copy of the client's current permissions,
+// safe to hand to a SignalMessage that may be read after permissions
+// changes again.
+func (c *Client) permissionsSnapshot() []Permission {
+	c.permMu.Lock()
+	defer c.permMu.Unlock()
+	return append([]Permission(nil), c.permissions...)
+}
+
+// setPermissions replaces the client's permissions wholesale, used when
+// assigning them on join or resume.
+func (c *Client) setPermissions(perms []Permission) {
+	c.permMu.Lock()
+	c.permissions = perms
+	c.permMu.Unlock()
+}
+
+// grantPermission adds p to the client's permissions if not already held,
+// and returns the resulting snapshot.
+func (c *Client) grantPermission(p Permission) []Permission {
+	c.permMu.Lock()
+	if !hasPermission(c.permissions, p) {
+		c.permissions = append(c.permissions, p)
+	}
+	snapshot := append([]Permission(nil), c.permissions...)
+	c.permMu.Unlock()
+	return snapshot
+}
+
+type Room struct {
+	maxPeers int
+	peers    map[string]*Client
+	sessions map[string]*Client
+
+	// SFU mode state; populated by sfuServer.initRoom only when the server
+	// is running with -sfu, left zero-valued otherwise.
+	sfuMu      sync.Mutex
+	pcs        map[string]*negotiatingPC
+	tracks     map[string]*webrtc.TrackLocalStaticRTP
+	publishers []sfuPublisher
+	pliStop    chan struct{}
+
+	// recMu guards recorder, which is non-nil only while the room has an
+	// active recording session (SFU mode only).
+	recMu    sync.Mutex
+	recorder *Recorder
+}
+
+func (r *Room) connectedPeers(excludeID string) []*Client {
+	var peers []*Client
+	for id, peer := range r.peers {
+		if id == excludeID || !peer.disconnectedAt.IsZero() {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (r *Room) connectedCount() int {
+	count := 0
+	for _, peer := range r.peers {
+		if peer.disconnectedAt.IsZero() {
+			count++
+		}
+	}
+	return count
+}
+
+type Hub struct {
+	mu    sync.Mutex
+	rooms map[string]*Room
+
+	// sfu is non-nil when the server was started with -sfu; the hub then
+	// forwards offer/answer/ice through it instead of relaying peer to
+	// peer.
+	sfu *sfuServer
+
+	// auth is non-nil when a room policy file or secret was configured;
+	// it gates handleJoin for rooms that have a registered policy.
+	auth *authManager
+
+	// recordingsDir is the base directory session recordings are written
+	// under; see recorder.go.
+	recordingsDir string
+}
+
+func newHub() *Hub {
+	return &Hub{
+		rooms: make(map[string]*Room),
+	}
+}
+
+func (h *Hub) getOrCreateRoom(id string, maxPeers int) *Room {
+	room := h.rooms[id]
+	if room == nil {
+		if maxPeers <= 0 {
+			maxPeers = defaultMaxPeers
+		}
+		room = &Room{
+			maxPeers: maxPeers,
+			peers:    make(map[string]*Client),
+			sessions: make(map[string]*Client),
+		}
+		h.rooms[id] = room
+		if h.sfu != nil {
+			h.sfu.initRoom(room)
+		}
+	}
+	return room
+}
+
+func (h *Hub) handleJoin(c *Client, msg SignalMessage) {
+	if !roomNamePattern.MatchString(msg.Room) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "invalid room name"})
+		return
+	}
+	if msg.SessionID == "" {
+		c.sendMessage(SignalMessage{Type: "error", Error: "sessionId is required"})
+		return
+	}
+
+	var grantedPermissions []Permission
+	if h.auth != nil {
+		granted, err := h.auth.authorize(msg.Room, msg.Token, msg.Password)
+		if err != nil {
+			c.sendMessage(SignalMessage{Type: "error", Error: "unauthorized"})
+			return
+		}
+		grantedPermissions = granted
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	isNewRoom := h.rooms[msg.Room] == nil
+	room := h.getOrCreateRoom(msg.Room, msg.MaxPeers)
+
+	if isNewRoom && msg.Record && h.sfu != nil {
+		if rec, err := newRecorder(h.recordingsDir, msg.Room); err != nil {
+			log.Printf("recorder: failed to start recording for room %s: %v", msg.Room, err)
+		} else {
+			room.recorder = rec
+		}
+	}
+
+	resumed := false
+	if existing := room.sessions[msg.SessionID]; existing != nil {
+		if existing.disconnectTimer != nil {
+			existing.disconnectTimer.Stop()
+		}
+		delete(room.peers, existing.id)
+		delete(room.sessions, existing.sessionID)
+
+		if !existing.disconnectedAt.IsZero() {
+			resumed = true
+			c.id = existing.id
+			c.setPermissions(existing.permissionsSnapshot())
+			c.knownPeers = existing.knownPeers
+
+			existing.historyMu.Lock()
+			c.history = append([]SignalMessage(nil), existing.history...)
+			c.nextSeq = existing.nextSeq
+			existing.historyMu.Unlock()
+		}
+	}
+
+	if room.connectedCount() >= room.maxPeers {
+		c.sendMessage(SignalMessage{Type: "error", Error: "room full"})
+		return
+	}
+
+	c.room = msg.Room
+	c.sessionID = msg.SessionID
+	if !resumed {
+		switch {
+		case grantedPermissions != nil:
+			c.setPermissions(grantedPermissions)
+		case isNewRoom:
+			c.setPermissions(creatorPermissions())
+		default:
+			c.setPermissions(defaultPermissions())
+		}
+	}
+
+	roster := room.connectedPeers(c.id)
+
+	room.peers[c.id] = c
+	room.sessions[c.sessionID] = c
+
+	c.sendMessage(SignalMessage{
+		Type:        "joined",
+		Room:        c.room,
+		ClientID:    c.id,
+		Permissions: c.permissionsSnapshot(),
+	})
+
+	if resumed {
+		c.replay(msg.LastSeq)
+	}
+
+	current := make(map[string]bool, len(roster))
+	for _, peer := range roster {
+		current[peer.id] = true
+	}
+	peerStateChanged := !resumed || !sameIDs(c.knownPeers, current)
+	c.knownPeers = current
+
+	if !peerStateChanged {
+		return
+	}
+
+	if len(roster) == 0 {
+		c.sendMessage(SignalMessage{Type: "waiting", Status: "waiting"})
+		return
+	}
+
+	for _, peer := range roster {
+		c.sendMessage(SignalMessage{
+			Type:        "peer-joined",
+			ClientID:    peer.id,
+			Permissions: peer.permissionsSnapshot(),
+			Offerer:     true,
+		})
+		peer.sendMessage(SignalMessage{
+			Type:        "peer-joined",
+			ClientID:    c.id,
+			Permissions: c.permissionsSnapshot(),
+			Offerer:     false,
+		})
+		peer.knownPeers[c.id] = true
+	}
+}
+
+func sameIDs(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if !b[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Hub) relay(c *Client, msg SignalMessage) {
+	if msg.Type == "offer" && !c.can(PermPresent) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to present"})
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[c.room]
+	var peer *Client
+	if room != nil && msg.TargetID != "" {
+		peer = room.peers[msg.TargetID]
+	}
+	h.mu.Unlock()
+	if peer == nil {
+		return
+	}
+
+	msg.FromID = c.id
+	peer.sendMessage(msg)
+}
+
+func (h *Hub) handleChat(c *Client, msg SignalMessage) {
+	if !c.can(PermMessage) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to chat"})
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[c.room]
+	var peers []*Client
+	if room != nil {
+		peers = room.connectedPeers(c.id)
+	}
+	h.mu.Unlock()
+
+	out := SignalMessage{Type: "chat", FromID: c.id, Text: msg.Text}
+	for _, peer := range peers {
+		peer.sendMessage(out)
+	}
+}
+
+func (h *Hub) handleKick(c *Client, msg SignalMessage) {
+	if !c.can(PermOp) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to kick"})
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[c.room]
+	var target *Client
+	if room != nil {
+		target = room.peers[msg.TargetID]
+	}
+	h.mu.Unlock()
+	if target == nil {
+		return
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "kicked: "+msg.Reason)
+	_ = target.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	_ = target.conn.Close()
+}
+
+func (h *Hub) handleMute(c *Client, msg SignalMessage) {
+	if !c.can(PermOp) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to mute"})
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[c.room]
+	var target *Client
+	if room != nil {
+		target = room.peers[msg.TargetID]
+	}
+	h.mu.Unlock()
+	if target == nil {
+		return
+	}
+
+	target.sendMessage(SignalMessage{Type: "mute", FromID: c.id, Reason: msg.Reason})
+}
+
+func (h *Hub) handleOp(c *Client, msg SignalMessage) {
+	if !c.can(PermOp) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to grant op"})
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[c.room]
+	var target *Client
+	if room != nil {
+		target = room.peers[msg.TargetID]
+	}
+	h.mu.Unlock()
+	if target == nil {
+		return
+	}
+
+	granted := target.grantPermission(PermOp)
+	target.sendMessage(SignalMessage{Type: "permissions", Permissions: granted})
+}
+
+// handleRecordControl lets an op start or stop recording on an already
+// running room. Recording only works in SFU mode, since only then does the
+// server see the raw RTP.
+func (h *Hub) handleRecordControl(c *Client, msg SignalMessage) {
+	if !c.can(PermOp) {
+		c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to control recording"})
+		return
+	}
+	if h.sfu == nil {
+		c.sendMessage(SignalMessage{Type: "error", Error: "recording requires sfu mode"})
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[c.room]
+	h.mu.Unlock()
+	if room == nil {
+		return
+	}
+
+	switch msg.Type {
+	case "record":
+		room.recMu.Lock()
+		if room.recorder == nil {
+			if rec, err := newRecorder(h.recordingsDir, c.room); err != nil {
+				log.Printf("recorder: failed to start recording for room %s: %v", c.room, err)
+			} else {
+				room.recorder = rec
+			}
+		}
+		room.recMu.Unlock()
+	case "stop-record":
+		room.recMu.Lock()
+		rec := room.recorder
+		room.recorder = nil
+		room.recMu.Unlock()
+		if rec != nil {
+			rec.stopAll()
+		}
+	}
+}
+
+// handleRecordings lists the recording sessions stored for a room, gated by
+// an op-permission token (?token=) since recordings may contain anything
+// said or shown in the room.
+func (h *Hub) handleRecordings(w http.ResponseWriter, r *http.Request) {
+	room := strings.TrimPrefix(r.URL.Path, "/recordings/")
+	if !roomNamePattern.MatchString(room) {
+		http.Error(w, "invalid room name", http.StatusBadRequest)
+		return
+	}
+
+	if h.auth == nil {
+		http.Error(w, "recordings listing requires room authorization to be configured", http.StatusServiceUnavailable)
+		return
+	}
+	claims, err := h.auth.verifyToken(r.URL.Query().Get("token"))
+	if err != nil || claims.Room != room || !hasPermission(claims.Permissions, PermOp) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entries, err := os.ReadDir(filepath.Join(h.recordingsDir, room))
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "failed to list recordings", http.StatusInternalServerError)
+		return
+	}
+
+	sessions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			sessions = append(sessions, e.Name())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Sessions []string `json:"sessions"`
+	}{Sessions: sessions})
+}
+
+func (h *Hub) handleWS(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("upgrade error: %v", err)
+		return
+	}
+
+	client := &Client{
+		id:   randomID(),
+		conn: conn,
+		send: make(chan SignalMessage, 16),
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	go client.writeLoop()
+	client.readLoop(h)
+}
+
+// sendMessage tags msg with the next sequence number and records it in the
+// client's replay history regardless of connection state, then delivers it
+// if the client is currently connected. A disconnected client's messages
+// are buffered for resume rather than pushed onto its (possibly already
+// torn down) send channel.
+func (c *Client) sendMessage(msg SignalMessage) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	c.nextSeq++
+	msg.Seq = c.nextSeq
+	c.history = append(c.history, msg)
+	if len(c.history) > maxHistory {
+		c.history = c.history[len(c.history)-maxHistory:]
+	}
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+	}
+}
+
+// replay resends every buffered message with Seq greater than after,
+// without re-tagging or re-recording it, for a client that just resumed.
+func (c *Client) replay(after uint64) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if c.closed {
+		return
+	}
+	for _, msg := range c.history {
+		if msg.Seq > after {
+			select {
+			case c.send <- msg:
+			default:
+			}
+		}
+	}
+}
+
+// closeSend marks the client closed and closes its send channel, under the
+// same lock sendMessage/replay check before sending, so neither can ever
+// send on an already-closed channel.
+func (c *Client) closeSend() {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+}
+
+func (c *Client) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingPeriod)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) readLoop(h *Hub) {
+	defer func() {
+		h.handleDisconnect(c)
+		c.closeSend()
+	}()
+
+	for {
+		var msg SignalMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			return
+		}
+
+		if c.room == "" {
+			if msg.Type != "join" {
+				c.sendMessage(SignalMessage{Type: "error", Error: "must join first"})
+				continue
+			}
+			h.handleJoin(c, msg)
+			continue
+		}
+
+		switch msg.Type {
+		case "offer", "answer", "ice":
+			if h.sfu != nil {
+				h.mu.Lock()
+				room := h.rooms[c.room]
+				h.mu.Unlock()
+				if room != nil {
+					h.sfu.handleSignal(room, c, msg)
+				}
+				continue
+			}
+			h.relay(c, msg)
+		case "chat":
+			h.handleChat(c, msg)
+		case "kick":
+			h.handleKick(c, msg)
+		case "mute":
+			h.handleMute(c, msg)
+		case "op":
+			h.handleOp(c, msg)
+		case "record", "stop-record":
+			h.handleRecordControl(c, msg)
+		}
+	}
+}
+
+func randomID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (h *Hub) handleDisconnect(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room := h.rooms[c.room]
+	if room == nil {
+		return
+	}
+
+	peer, ok := room.peers[c.id]
+	if !ok || peer != c {
+		return
+	}
+
+	c.disconnectedAt = time.Now()
+	if c.disconnectTimer != nil {
+		c.disconnectTimer.Stop()
+	}
+
+	for _, other := range room.connectedPeers(c.id) {
+		other.sendMessage(SignalMessage{Type: "peer-left", ClientID: c.id})
+		delete(other.knownPeers, c.id)
+	}
+
+	c.disconnectTimer = time.AfterFunc(disconnectGrace, func() {
+		h.finalizeDisconnect(c.room, c.id, c.sessionID)
+	})
+}
+
+func (h *Hub) finalizeDisconnect(roomID, clientID, sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room := h.rooms[roomID]
+	if room == nil {
+		return
+	}
+
+	peer := room.peers[clientID]
+	if peer == nil || peer.sessionID != sessionID {
+		return
+	}
+	if peer.disconnectedAt.IsZero() {
+		return
+	}
+
+	delete(room.peers, clientID)
+	delete(room.sessions, sessionID)
+
+	if h.sfu != nil {
+		h.sfu.onClientLeft(room, clientID)
+	}
+
+	if len(room.peers) == 0 {
+		if h.sfu != nil {
+			h.sfu.closeRoom(room)
+		}
+		room.recMu.Lock()
+		rec := room.recorder
+		room.recorder = nil
+		room.recMu.Unlock()
+		if rec != nil {
+			rec.stopAll()
+		}
+		delete(h.rooms, roomID)
+	}
+}
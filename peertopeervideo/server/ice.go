@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// turnCredentialTTL is how long a minted TURN REST API credential remains
+// valid.
+const turnCredentialTTL = 12 * time.Hour
+
+// iceServerConfig mirrors webrtc.ICEServer plus an optional shared secret
+// used to mint short-lived TURN REST API credentials.
+type iceServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	TURNSecret string   `json:"turnSecret,omitempty"`
+}
+
+// iceManager serves the configured ICE/TURN servers to clients and reloads
+// them from disk on SIGHUP (unconditionally) or when polling sees the file's
+// mtime change.
+type iceManager struct {
+	path string
+
+	mu      sync.RWMutex
+	servers []iceServerConfig
+	modTime time.Time
+}
+
+func newICEManager(path string) (*iceManager, error) {
+	m := &iceManager{path: path}
+	if path == "" {
+		return m, nil
+	}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *iceManager) reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	var servers []iceServerConfig
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return fmt.Errorf("parse %s: %w", m.path, err)
+	}
+
+	m.mu.Lock()
+	m.servers = servers
+	m.modTime = info.ModTime()
+	m.mu.Unlock()
+
+	log.Printf("ice: reloaded %d server(s) from %s", len(servers), m.path)
+	return nil
+}
+
+// watchReload polls the ICE file for mtime changes every interval so a
+// deployment can update it in place without a restart or a signal.
+func (m *iceManager) watchReload(interval time.Duration) {
+	if m.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if info, err := os.Stat(m.path); err == nil {
+			m.mu.RLock()
+			unchanged := info.ModTime().Equal(m.modTime)
+			m.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+		if err := m.reload(); err != nil {
+			log.Printf("ice: reload failed: %v", err)
+		}
+	}
+}
+
+func (m *iceManager) handleICE(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	servers := make([]iceServerConfig, len(m.servers))
+	copy(servers, m.servers)
+	m.mu.RUnlock()
+
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		user = "guest"
+	}
+
+	out := make([]iceServerConfig, len(servers))
+	for i, s := range servers {
+		if s.TURNSecret != "" {
+			s.Username, s.Credential = mintTURNCredential(s.TURNSecret, user, turnCredentialTTL)
+			s.TURNSecret = ""
+		}
+		out[i] = s
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		ICEServers []iceServerConfig `json:"iceServers"`
+	}{ICEServers: out})
+}
+
+// mintTURNCredential implements the coturn-compatible TURN REST API scheme:
+// username is "<expiry-unix>:<user>" and credential is the base64-encoded
+// HMAC-SHA1 of that username keyed by the shared secret. This lets clients
+// authenticate to the TURN server without ever seeing the long-term secret.
+func mintTURNCredential(secret, user string, ttl time.Duration) (username, credential string) {
+	expiry := time.Now().Add(ttl).Unix()
+	username = fmt.Sprintf("%d:%s", expiry, user)
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return username, credential
+}
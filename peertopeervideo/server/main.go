@@ -1,317 +1,68 @@
 package main
 
 import (
-	"crypto/rand"
 	"embed"
-	"encoding/hex"
-	"encoding/json"
+	"flag"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/pion/ice/v2"
 )
 
-type SignalMessage struct {
-	Type      string          `json:"type"`
-	Room      string          `json:"room,omitempty"`
-	SessionID string          `json:"sessionId,omitempty"`
-	ClientID  string          `json:"clientId,omitempty"`
-	FromID    string          `json:"fromId,omitempty"`
-	TargetID  string          `json:"targetId,omitempty"`
-	SDP       string          `json:"sdp,omitempty"`
-	Candidate json.RawMessage `json:"candidate,omitempty"`
-	Offerer   bool            `json:"offerer,omitempty"`
-	Status    string          `json:"status,omitempty"`
-	Error     string          `json:"error,omitempty"`
-}
-
-type Client struct {
-	id               string
-	sessionID        string
-	room             string
-	conn             *websocket.Conn
-	send             chan SignalMessage
-	disconnectedAt   time.Time
-	disconnectTimer  *time.Timer
-}
-
-type Room struct {
-	peers    map[string]*Client
-	sessions map[string]*Client
-}
-
-type Hub struct {
-	mu    sync.Mutex
-	rooms map[string]*Room
-}
-
-func newHub() *Hub {
-	return &Hub{
-		rooms: make(map[string]*Room),
-	}
-}
-
-func (h *Hub) getOrCreateRoom(id string) *Room {
-	room := h.rooms[id]
-	if room == nil {
-		room = &Room{
-			peers:    make(map[string]*Client),
-			sessions: make(map[string]*Client),
-		}
-		h.rooms[id] = room
-	}
-	return room
-}
-
-func (h *Hub) handleJoin(c *Client, msg SignalMessage) {
-	if msg.Room == "" {
-		c.sendMessage(SignalMessage{Type: "error", Error: "room is required"})
-		return
-	}
-	if msg.SessionID == "" {
-		c.sendMessage(SignalMessage{Type: "error", Error: "sessionId is required"})
-		return
-	}
-
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	room := h.getOrCreateRoom(msg.Room)
-
-	if existing := room.sessions[msg.SessionID]; existing != nil {
-		if existing.disconnectTimer != nil {
-			existing.disconnectTimer.Stop()
-		}
-		delete(room.peers, existing.id)
-		delete(room.sessions, existing.sessionID)
-	}
-
-	connectedCount := 0
-	for _, peer := range room.peers {
-		if peer.disconnectedAt.IsZero() {
-			connectedCount++
-		}
-	}
-
-	if connectedCount >= 2 {
-		c.sendMessage(SignalMessage{Type: "error", Error: "room full"})
-		return
-	}
-
-	if connectedCount < 2 && len(room.peers) >= 2 {
-		for id, peer := range room.peers {
-			if !peer.disconnectedAt.IsZero() {
-				if peer.disconnectTimer != nil {
-					peer.disconnectTimer.Stop()
-				}
-				delete(room.peers, id)
-				delete(room.sessions, peer.sessionID)
-				break
-			}
-		}
-	}
-
-	c.room = msg.Room
-	c.sessionID = msg.SessionID
-	c.sendMessage(SignalMessage{
-		Type:     "joined",
-		Room:     c.room,
-		ClientID: c.id,
-	})
-
-	room.peers[c.id] = c
-	room.sessions[c.sessionID] = c
-
-	other := room.otherConnectedPeer(c.id)
-	if other == nil {
-		c.sendMessage(SignalMessage{Type: "waiting", Status: "waiting"})
-		return
-	}
+//go:embed web/*
+var webFiles embed.FS
 
-	other.sendMessage(SignalMessage{
-		Type:     "peer-joined",
-		ClientID: c.id,
-		Offerer:  false,
-	})
-	c.sendMessage(SignalMessage{
-		Type:     "peer-joined",
-		ClientID: other.id,
-		Offerer:  true,
-	})
-}
+// iceReloadInterval is how often the ICE file's mtime is polled for
+// hot-reload in addition to the SIGHUP trigger.
+const iceReloadInterval = 30 * time.Second
 
-func (h *Hub) relay(c *Client, msg SignalMessage) {
-	h.mu.Lock()
-	room := h.rooms[c.room]
-	h.mu.Unlock()
-	if room == nil {
-		return
-	}
+func main() {
+	iceFile := flag.String("ice-file", getEnv("ICE_FILE", ""), "path to a JSON file of ICE/TURN servers served at /ice")
+	sfuEnabled := flag.Bool("sfu", false, "act as an SFU, forwarding media through the server instead of peer-to-peer mesh")
+	iceTCPPort := flag.Int("ice-tcp-port", 0, "when set, also accept ICE over TCP on this port (SFU mode only)")
+	authSecret := flag.String("auth-secret", getEnv("AUTH_SECRET", ""), "secret used to sign/verify room join tokens; enables token auth when set")
+	roomPolicyFile := flag.String("room-policy-file", getEnv("ROOM_POLICY_FILE", ""), "path to a JSON file of per-room access policies")
+	recordingsDir := flag.String("recordings-dir", getEnv("RECORDINGS_DIR", defaultRecordingsDir), "directory session recordings are written under (SFU mode only)")
+	flag.Parse()
 
-	msg.FromID = c.id
+	hub := newHub()
+	hub.recordingsDir = *recordingsDir
 
-	if msg.TargetID == "" {
-		if other := room.otherConnectedPeer(c.id); other != nil {
-			msg.TargetID = other.id
+	if *authSecret != "" || *roomPolicyFile != "" {
+		auth, err := newAuthManager(*authSecret, *roomPolicyFile)
+		if err != nil {
+			log.Fatalf("failed to load room policy file %s: %v", *roomPolicyFile, err)
 		}
+		hub.auth = auth
 	}
-	if msg.TargetID == "" {
-		return
-	}
-	if peer := room.peers[msg.TargetID]; peer != nil {
-		peer.sendMessage(msg)
-	}
-}
 
-func (h *Hub) handleWS(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	iceMgr, err := newICEManager(*iceFile)
 	if err != nil {
-		log.Printf("upgrade error: %v", err)
-		return
+		log.Fatalf("failed to load ICE file %s: %v", *iceFile, err)
 	}
+	go iceMgr.watchReload(iceReloadInterval)
+	go watchSIGHUP(iceMgr)
 
-	client := &Client{
-		id:   randomID(),
-		conn: conn,
-		send: make(chan SignalMessage, 16),
-	}
-
-	go client.writeLoop()
-	client.readLoop(h)
-}
-
-func (c *Client) sendMessage(msg SignalMessage) {
-	select {
-	case c.send <- msg:
-	default:
-	}
-}
-
-func (c *Client) writeLoop() {
-	for msg := range c.send {
-		if err := c.conn.WriteJSON(msg); err != nil {
-			break
-		}
-	}
-	_ = c.conn.Close()
-}
-
-func (c *Client) readLoop(h *Hub) {
-	defer func() {
-		h.handleDisconnect(c)
-		close(c.send)
-	}()
-
-	for {
-		var msg SignalMessage
-		if err := c.conn.ReadJSON(&msg); err != nil {
-			return
-		}
-
-		if c.room == "" {
-			if msg.Type != "join" {
-				c.sendMessage(SignalMessage{Type: "error", Error: "must join first"})
-				continue
+	if *sfuEnabled {
+		var tcpMux ice.TCPMux
+		if *iceTCPPort > 0 {
+			tcpMux, err = newICETCPMux(*iceTCPPort)
+			if err != nil {
+				log.Fatalf("failed to start ICE TCP mux: %v", err)
 			}
-			h.handleJoin(c, msg)
-			continue
-		}
-
-		switch msg.Type {
-		case "offer", "answer", "ice":
-			h.relay(c, msg)
-		}
-	}
-}
-
-func randomID() string {
-	buf := make([]byte, 8)
-	if _, err := rand.Read(buf); err != nil {
-		return "unknown"
-	}
-	return hex.EncodeToString(buf)
-}
-
-func (h *Hub) handleDisconnect(c *Client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	room := h.rooms[c.room]
-	if room == nil {
-		return
-	}
-
-	peer, ok := room.peers[c.id]
-	if !ok || peer != c {
-		return
-	}
-
-	c.disconnectedAt = time.Now()
-	if c.disconnectTimer != nil {
-		c.disconnectTimer.Stop()
-	}
-
-	if other := room.otherConnectedPeer(c.id); other != nil {
-		other.sendMessage(SignalMessage{Type: "peer-left", ClientID: c.id})
-		other.sendMessage(SignalMessage{Type: "waiting", Status: "waiting"})
-	}
-
-	c.disconnectTimer = time.AfterFunc(5*time.Second, func() {
-		h.finalizeDisconnect(c.room, c.id, c.sessionID)
-	})
-}
-
-func (h *Hub) finalizeDisconnect(roomID, clientID, sessionID string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	room := h.rooms[roomID]
-	if room == nil {
-		return
-	}
-
-	peer := room.peers[clientID]
-	if peer == nil || peer.sessionID != sessionID {
-		return
-	}
-	if peer.disconnectedAt.IsZero() {
-		return
-	}
-
-	delete(room.peers, clientID)
-	delete(room.sessions, sessionID)
-
-	if len(room.peers) == 0 {
-		delete(h.rooms, roomID)
-	}
-}
-
-func (r *Room) otherConnectedPeer(excludeID string) *Client {
-	for id, peer := range r.peers {
-		if id == excludeID {
-			continue
 		}
-		if peer.disconnectedAt.IsZero() {
-			return peer
+		hub.sfu, err = newSFUServer(iceMgr, tcpMux)
+		if err != nil {
+			log.Fatalf("failed to start SFU: %v", err)
 		}
+		hub.sfu.hub = hub
+		log.Printf("sfu mode enabled")
 	}
-	return nil
-}
-
-//go:embed web/*
-var webFiles embed.FS
-
-func main() {
-	hub := newHub()
 
 	webDir, err := fs.Sub(webFiles, "web")
 	if err != nil {
@@ -320,6 +71,11 @@ func main() {
 
 	http.Handle("/", http.FileServer(http.FS(webDir)))
 	http.HandleFunc("/ws", hub.handleWS)
+	http.HandleFunc("/ice", iceMgr.handleICE)
+	if hub.auth != nil {
+		http.HandleFunc("/admin/rooms", hub.auth.handleAdminRooms)
+	}
+	http.HandleFunc("/recordings/", hub.handleRecordings)
 
 	addr := getEnv("ADDR", ":10011")
 	certFile := os.Getenv("TLS_CERT")
@@ -334,6 +90,18 @@ func main() {
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
 
+// watchSIGHUP reloads the ICE file whenever the process receives SIGHUP,
+// the conventional "reread your config" signal.
+func watchSIGHUP(ice *iceManager) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := ice.reload(); err != nil {
+			log.Printf("ice: reload on SIGHUP failed: %v", err)
+		}
+	}
+}
+
 func getEnv(key, fallback string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,35 @@
+package main
+
+// Permission is a capability granted to a client within a room.
+type Permission string
+
+const (
+	// PermOp lets a client issue admin actions: kick, mute, op, and room
+	// control messages.
+	PermOp Permission = "op"
+	// PermPresent lets a client publish audio/video into the room.
+	PermPresent Permission = "present"
+	// PermMessage lets a client send chat messages to the room.
+	PermMessage Permission = "message"
+)
+
+// defaultPermissions is granted to every client that is not the first to
+// join a room.
+func defaultPermissions() []Permission {
+	return []Permission{PermPresent, PermMessage}
+}
+
+// creatorPermissions is granted to the client that creates a room by being
+// the first to join it.
+func creatorPermissions() []Permission {
+	return []Permission{PermOp, PermPresent, PermMessage}
+}
+
+func hasPermission(perms []Permission, want Permission) bool {
+	for _, p := range perms {
+		if p == want {
+			return true
+		}
+	}
+	return false
+}
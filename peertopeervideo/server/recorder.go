@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// defaultRecordingsDir is where session recordings land when -recordings-dir
+// is not set.
+const defaultRecordingsDir = "recordings"
+
+// Recorder owns one file per track for a single room session: the SFU
+// forwarding loop hands it every RTP packet it reads off a TrackRemote, and
+// it lazily opens a pion media writer per track that depacketizes into the
+// right container.
+type Recorder struct {
+	dir string
+
+	mu      sync.Mutex
+	writers map[string]media.Writer
+}
+
+// newRecorder creates the directory <baseDir>/<room>/<sessionStart> and
+// returns a Recorder that writes tracks under it.
+func newRecorder(baseDir, room string) (*Recorder, error) {
+	if baseDir == "" {
+		baseDir = defaultRecordingsDir
+	}
+	dir := filepath.Join(baseDir, room, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, writers: make(map[string]media.Writer)}, nil
+}
+
+// write appends packet to the file for key, opening it on first use. key is
+// typically "<clientID>-<trackID>".
+func (rec *Recorder) write(key, mimeType string, packet *rtp.Packet) {
+	rec.mu.Lock()
+	writer, ok := rec.writers[key]
+	if !ok {
+		w, err := newMediaWriter(rec.dir, key, mimeType)
+		if err != nil {
+			rec.mu.Unlock()
+			log.Printf("recorder: %v", err)
+			return
+		}
+		writer = w
+		rec.writers[key] = writer
+	}
+	rec.mu.Unlock()
+
+	if err := writer.WriteRTP(packet); err != nil {
+		log.Printf("recorder: write %s: %v", key, err)
+		rec.closeTrack(key)
+	}
+}
+
+// closeTrack closes and forgets the writer for key, if one is open. Called
+// when a track's owner leaves so its file is flushed promptly instead of
+// staying open until the whole recording stops.
+func (rec *Recorder) closeTrack(key string) {
+	rec.mu.Lock()
+	writer, ok := rec.writers[key]
+	if ok {
+		delete(rec.writers, key)
+	}
+	rec.mu.Unlock()
+
+	if ok {
+		_ = writer.Close()
+	}
+}
+
+// stopAll closes every writer owned by this recorder.
+func (rec *Recorder) stopAll() {
+	rec.mu.Lock()
+	writers := make([]media.Writer, 0, len(rec.writers))
+	for _, w := range rec.writers {
+		writers = append(writers, w)
+	}
+	rec.writers = make(map[string]media.Writer)
+	rec.mu.Unlock()
+
+	for _, w := range writers {
+		_ = w.Close()
+	}
+}
+
+func newMediaWriter(dir, key, mimeType string) (media.Writer, error) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return ivfwriter.New(filepath.Join(dir, key+".ivf"))
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return h264writer.New(filepath.Join(dir, key+".h264"))
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return oggwriter.New(filepath.Join(dir, key+".ogg"), 48000, 2)
+	default:
+		return nil, fmt.Errorf("no recorder for codec %s", mimeType)
+	}
+}
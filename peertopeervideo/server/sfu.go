@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// pliInterval is how often each room's publishers are sent a Picture Loss
+// Indication so decoders keep getting fresh keyframes.
+const pliInterval = 3 * time.Second
+
+// sfuPublisher is a track being forwarded from one client's PeerConnection
+// to the rest of the room; it is kept around so the PLI ticker can ask the
+// originating connection for a new keyframe.
+type sfuPublisher struct {
+	pc   *webrtc.PeerConnection
+	ssrc webrtc.SSRC
+}
+
+// negotiatingPC pairs a PeerConnection with the mutex that serializes every
+// call that mutates its signaling state (SetRemoteDescription,
+// SetLocalDescription, CreateOffer, CreateAnswer, AddTrack). Without it, a
+// newcomer's handleOffer and a concurrently arriving publisher's
+// addTrackAndRenegotiate can drive the same connection's negotiation from
+// two goroutines at once.
+type negotiatingPC struct {
+	pc     *webrtc.PeerConnection
+	negoMu sync.Mutex
+}
+
+// sfuServer makes the signaling server itself act as a WebRTC peer,
+// forwarding media between clients instead of having them mesh directly.
+// This lifts the two-peer cap and keeps per-client bandwidth to one
+// upload/one set of downloads regardless of room size.
+type sfuServer struct {
+	api *webrtc.API
+	ice *iceManager
+
+	// hub is set by main right after construction, so onRemoteTrack can
+	// take h.mu before reading room.peers, the same lock every other
+	// accessor of that map uses.
+	hub *Hub
+}
+
+func newSFUServer(iceMgr *iceManager, tcpMux ice.TCPMux) (*sfuServer, error) {
+	me := &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("register default codecs: %w", err)
+	}
+
+	se := webrtc.SettingEngine{}
+	if tcpMux != nil {
+		se.SetICETCPMux(tcpMux)
+		se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6})
+	}
+	return &sfuServer{
+		api: webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(se)),
+		ice: iceMgr,
+	}, nil
+}
+
+// newICETCPMux listens on port and returns a mux suitable for
+// SettingEngine.SetICETCPMux, for deployments behind NATs that only allow
+// outbound TCP.
+func newICETCPMux(port int) (ice.TCPMux, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("ice tcp mux: %w", err)
+	}
+	return webrtc.NewICETCPMux(nil, listener, 8192), nil
+}
+
+func (s *sfuServer) initRoom(room *Room) {
+	room.pcs = make(map[string]*negotiatingPC)
+	room.tracks = make(map[string]*webrtc.TrackLocalStaticRTP)
+	room.pliStop = make(chan struct{})
+	go s.pliLoop(room)
+}
+
+func (s *sfuServer) pliLoop(room *Room) {
+	ticker := time.NewTicker(pliInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			room.sfuMu.Lock()
+			publishers := make([]sfuPublisher, len(room.publishers))
+			copy(publishers, room.publishers)
+			room.sfuMu.Unlock()
+
+			for _, p := range publishers {
+				_ = p.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(p.ssrc)}})
+			}
+		case <-room.pliStop:
+			return
+		}
+	}
+}
+
+func (s *sfuServer) closeRoom(room *Room) {
+	room.sfuMu.Lock()
+	defer room.sfuMu.Unlock()
+
+	close(room.pliStop)
+	for _, entry := range room.pcs {
+		_ = entry.pc.Close()
+	}
+}
+
+// onClientLeft tears down clientID's PeerConnection and forgets its
+// published tracks. Closing the PeerConnection ends any in-flight
+// forwardRTP goroutines reading from its remote tracks, so
+// recordings for this client are flushed and closed promptly.
+func (s *sfuServer) onClientLeft(room *Room, clientID string) {
+	room.sfuMu.Lock()
+	entry := room.pcs[clientID]
+	delete(room.pcs, clientID)
+	for key := range room.tracks {
+		if ownerOfTrackKey(key) == clientID {
+			delete(room.tracks, key)
+		}
+	}
+	var pc *webrtc.PeerConnection
+	if entry != nil {
+		pc = entry.pc
+	}
+	remaining := room.publishers[:0]
+	for _, p := range room.publishers {
+		if p.pc != pc {
+			remaining = append(remaining, p)
+		}
+	}
+	room.publishers = remaining
+	room.sfuMu.Unlock()
+
+	if pc != nil {
+		_ = pc.Close()
+	}
+}
+
+// handleSignal processes an "offer"/"answer"/"ice" message from a client in
+// SFU mode, where every negotiation is between the client and the server's
+// own PeerConnection rather than another client.
+func (s *sfuServer) handleSignal(room *Room, c *Client, msg SignalMessage) {
+	switch msg.Type {
+	case "offer":
+		if !c.can(PermPresent) {
+			c.sendMessage(SignalMessage{Type: "error", Error: "not allowed to present"})
+			return
+		}
+		s.handleOffer(room, c, msg)
+	case "answer":
+		room.sfuMu.Lock()
+		entry := room.pcs[c.id]
+		room.sfuMu.Unlock()
+		if entry == nil {
+			return
+		}
+		entry.negoMu.Lock()
+		err := entry.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: msg.SDP})
+		entry.negoMu.Unlock()
+		if err != nil {
+			log.Printf("sfu: set remote answer for %s: %v", c.id, err)
+		}
+	case "ice":
+		room.sfuMu.Lock()
+		entry := room.pcs[c.id]
+		room.sfuMu.Unlock()
+		if entry == nil || len(msg.Candidate) == 0 {
+			return
+		}
+		pc := entry.pc
+		var candidate webrtc.ICECandidateInit
+		if err := json.Unmarshal(msg.Candidate, &candidate); err != nil {
+			log.Printf("sfu: bad ice candidate from %s: %v", c.id, err)
+			return
+		}
+		if err := pc.AddICECandidate(candidate); err != nil {
+			log.Printf("sfu: add ice candidate for %s: %v", c.id, err)
+		}
+	}
+}
+
+func (s *sfuServer) handleOffer(room *Room, c *Client, msg SignalMessage) {
+	entry, err := s.getOrCreatePeerConnection(room, c)
+	if err != nil {
+		c.sendMessage(SignalMessage{Type: "error", Error: "sfu negotiation failed"})
+		log.Printf("sfu: new peer connection for %s: %v", c.id, err)
+		return
+	}
+
+	// Hold negoMu across the whole offer/answer exchange so a concurrently
+	// arriving publisher's addTrackAndRenegotiate can't interleave its own
+	// AddTrack/CreateOffer/SetLocalDescription on this same connection.
+	entry.negoMu.Lock()
+	defer entry.negoMu.Unlock()
+	pc := entry.pc
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: msg.SDP}); err != nil {
+		log.Printf("sfu: set remote offer for %s: %v", c.id, err)
+		return
+	}
+
+	// Give the newcomer everyone else's tracks before answering so they
+	// arrive negotiated in the same session description.
+	room.sfuMu.Lock()
+	for key, track := range room.tracks {
+		if ownerOfTrackKey(key) == c.id {
+			continue
+		}
+		if _, err := pc.AddTrack(track); err != nil {
+			log.Printf("sfu: add existing track %s to %s: %v", key, c.id, err)
+		}
+	}
+	room.sfuMu.Unlock()
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("sfu: create answer for %s: %v", c.id, err)
+		return
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Printf("sfu: set local answer for %s: %v", c.id, err)
+		return
+	}
+
+	c.sendMessage(SignalMessage{Type: "answer", SDP: answer.SDP})
+}
+
+func (s *sfuServer) getOrCreatePeerConnection(room *Room, c *Client) (*negotiatingPC, error) {
+	room.sfuMu.Lock()
+	if entry, ok := room.pcs[c.id]; ok {
+		room.sfuMu.Unlock()
+		return entry, nil
+	}
+	room.sfuMu.Unlock()
+
+	config := webrtc.Configuration{}
+	if s.ice != nil {
+		config.ICEServers = s.ice.webrtcServers("sfu-" + c.id)
+	}
+
+	pc, err := s.api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		payload, err := json.Marshal(candidate.ToJSON())
+		if err != nil {
+			return
+		}
+		c.sendMessage(SignalMessage{Type: "ice", Candidate: payload})
+	})
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		s.onRemoteTrack(room, c, pc, remote, receiver)
+	})
+
+	entry := &negotiatingPC{pc: pc}
+	room.sfuMu.Lock()
+	room.pcs[c.id] = entry
+	room.sfuMu.Unlock()
+
+	return entry, nil
+}
+
+func trackKey(ownerID, trackID string) string {
+	return ownerID + "/" + trackID
+}
+
+// recordingKey builds the key a Recorder uses to name a track's file on
+// disk. Unlike trackKey, it must not contain a path separator, so it uses a
+// dash rather than a slash; trackID comes from the remote SDP and is
+// sanitized since it is otherwise attacker-controlled.
+func recordingKey(ownerID, trackID string) string {
+	return ownerID + "-" + sanitizeFilenameComponent(trackID)
+}
+
+// sanitizeFilenameComponent replaces every character that isn't safe to use
+// unescaped in a single path segment, so a track ID crafted by a client
+// can't escape the recordings directory.
+func sanitizeFilenameComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, s)
+}
+
+func ownerOfTrackKey(key string) string {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '/' {
+			return key[:i]
+		}
+	}
+	return key
+}
+
+func (s *sfuServer) onRemoteTrack(room *Room, owner *Client, ownerPC *webrtc.PeerConnection, remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), remote.StreamID())
+	if err != nil {
+		log.Printf("sfu: create local track for %s: %v", owner.id, err)
+		return
+	}
+
+	key := trackKey(owner.id, remote.ID())
+	room.sfuMu.Lock()
+	room.tracks[key] = local
+	room.publishers = append(room.publishers, sfuPublisher{pc: ownerPC, ssrc: remote.SSRC()})
+	peerIDs := make([]string, 0, len(room.pcs))
+	for id := range room.pcs {
+		if id != owner.id {
+			peerIDs = append(peerIDs, id)
+		}
+	}
+	room.sfuMu.Unlock()
+
+	s.hub.mu.Lock()
+	peers := make([]*Client, 0, len(peerIDs))
+	for _, id := range peerIDs {
+		peers = append(peers, room.peers[id])
+	}
+	s.hub.mu.Unlock()
+
+	go s.forwardRTP(room, remote, local, recordingKey(owner.id, remote.ID()))
+
+	for _, peer := range peers {
+		if peer != nil {
+			s.addTrackAndRenegotiate(room, peer, local)
+		}
+	}
+}
+
+// forwardRTP copies remote's RTP packets onto local for every other peer in
+// the room, and, while the room has an active Recorder, also writes them to
+// disk under key. It ends when remote's PeerConnection closes.
+func (s *sfuServer) forwardRTP(room *Room, remote *webrtc.TrackRemote, local *webrtc.TrackLocalStaticRTP, key string) {
+	mimeType := remote.Codec().MimeType
+
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			break
+		}
+		if err := local.WriteRTP(packet); err != nil {
+			break
+		}
+
+		room.recMu.Lock()
+		rec := room.recorder
+		room.recMu.Unlock()
+		if rec != nil {
+			rec.write(key, mimeType, packet)
+		}
+	}
+
+	room.recMu.Lock()
+	rec := room.recorder
+	room.recMu.Unlock()
+	if rec != nil {
+		rec.closeTrack(key)
+	}
+}
+
+func (s *sfuServer) addTrackAndRenegotiate(room *Room, peer *Client, track *webrtc.TrackLocalStaticRTP) {
+	room.sfuMu.Lock()
+	entry := room.pcs[peer.id]
+	room.sfuMu.Unlock()
+	if entry == nil {
+		return
+	}
+
+	entry.negoMu.Lock()
+	defer entry.negoMu.Unlock()
+	pc := entry.pc
+
+	if _, err := pc.AddTrack(track); err != nil {
+		log.Printf("sfu: add track to %s: %v", peer.id, err)
+		return
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		log.Printf("sfu: create renegotiation offer for %s: %v", peer.id, err)
+		return
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		log.Printf("sfu: set local renegotiation offer for %s: %v", peer.id, err)
+		return
+	}
+
+	peer.sendMessage(SignalMessage{Type: "offer", SDP: offer.SDP})
+}
+
+// webrtcServers converts the configured ICE/TURN servers to pion's type,
+// minting fresh TURN REST credentials for any entry that has a secret.
+func (m *iceManager) webrtcServers(user string) []webrtc.ICEServer {
+	m.mu.RLock()
+	servers := make([]iceServerConfig, len(m.servers))
+	copy(servers, m.servers)
+	m.mu.RUnlock()
+
+	out := make([]webrtc.ICEServer, len(servers))
+	for i, srv := range servers {
+		username, credential := srv.Username, srv.Credential
+		if srv.TURNSecret != "" {
+			username, credential = mintTURNCredential(srv.TURNSecret, user, turnCredentialTTL)
+		}
+		out[i] = webrtc.ICEServer{
+			URLs:       srv.URLs,
+			Username:   username,
+			Credential: credential,
+		}
+	}
+	return out
+}
@@ -0,0 +1,29 @@
+package main
+
+import "encoding/json"
+
+// SignalMessage is the envelope exchanged over the signaling websocket. Not
+// every field is used by every message Type; see the handlers in hub.go for
+// which fields each type reads.
+type SignalMessage struct {
+	Type        string          `json:"type"`
+	Room        string          `json:"room,omitempty"`
+	SessionID   string          `json:"sessionId,omitempty"`
+	ClientID    string          `json:"clientId,omitempty"`
+	FromID      string          `json:"fromId,omitempty"`
+	TargetID    string          `json:"targetId,omitempty"`
+	SDP         string          `json:"sdp,omitempty"`
+	Candidate   json.RawMessage `json:"candidate,omitempty"`
+	Offerer     bool            `json:"offerer,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Permissions []Permission    `json:"permissions,omitempty"`
+	Text        string          `json:"text,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	MaxPeers    int             `json:"maxPeers,omitempty"`
+	Token       string          `json:"token,omitempty"`
+	Password    string          `json:"password,omitempty"`
+	Record      bool            `json:"record,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	LastSeq     uint64          `json:"lastSeq,omitempty"`
+}